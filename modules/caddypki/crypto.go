@@ -21,10 +21,16 @@ import (
 	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/crypto/pkcs12"
 )
 
 func pemDecodeSingleCert(pemDER []byte) (*x509.Certificate, error) {
@@ -41,6 +47,32 @@ func pemDecodeSingleCert(pemDER []byte) (*x509.Certificate, error) {
 	return x509.ParseCertificate(pemBlock.Bytes)
 }
 
+// pemDecodeCertBundle decodes all CERTIFICATE PEM blocks found in pemDER,
+// in order, allowing a leaf certificate to be bundled together with any
+// number of intermediates, as in a CA-issued fullchain.pem.
+func pemDecodeCertBundle(pemDER []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var pemBlock *pem.Block
+		pemBlock, pemDER = pem.Decode(pemDER)
+		if pemBlock == nil {
+			break
+		}
+		if pemBlock.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no CERTIFICATE PEM blocks found")
+	}
+	return certs, nil
+}
+
 func pemEncodeCert(der []byte) ([]byte, error) {
 	return pemEncode("CERTIFICATE", der)
 }
@@ -79,18 +111,35 @@ func pemEncodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
 // https://github.com/golang/go/blob/693748e9fa385f1e2c3b91ca9acbb6c0ad2d133d/src/crypto/tls/tls.go#L291-L308
 // https://github.com/golang/go/blob/693748e9fa385f1e2c3b91ca9acbb6c0ad2d133d/src/crypto/tls/tls.go#L238)
 // TODO: this is the same thing as in certmagic. Should we reuse that code somehow? It's unexported.
-func pemDecodePrivateKey(keyPEMBytes []byte) (crypto.PrivateKey, error) {
+// passphrase is used to decrypt the key if it is PEM-encrypted (i.e. it has
+// a "Proc-Type: 4,ENCRYPTED" header); it is ignored otherwise.
+func pemDecodePrivateKey(keyPEMBytes []byte, passphrase []byte) (crypto.PrivateKey, error) {
 	keyBlockDER, _ := pem.Decode(keyPEMBytes)
+	if keyBlockDER == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
 
 	if keyBlockDER.Type != "PRIVATE KEY" && !strings.HasSuffix(keyBlockDER.Type, " PRIVATE KEY") {
 		return nil, fmt.Errorf("unknown PEM header %q", keyBlockDER.Type)
 	}
 
-	if key, err := x509.ParsePKCS1PrivateKey(keyBlockDER.Bytes); err == nil {
+	derBytes := keyBlockDER.Bytes
+	if x509.IsEncryptedPEMBlock(keyBlockDER) { //nolint:staticcheck
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("private key is encrypted, but no passphrase was given")
+		}
+		var err error
+		derBytes, err = x509.DecryptPEMBlock(keyBlockDER, passphrase) //nolint:staticcheck
+		if err != nil {
+			return nil, fmt.Errorf("decrypting private key: %v", err)
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(derBytes); err == nil {
 		return key, nil
 	}
 
-	if key, err := x509.ParsePKCS8PrivateKey(keyBlockDER.Bytes); err == nil {
+	if key, err := x509.ParsePKCS8PrivateKey(derBytes); err == nil {
 		switch key := key.(type) {
 		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return key, nil
@@ -99,7 +148,7 @@ func pemDecodePrivateKey(keyPEMBytes []byte) (crypto.PrivateKey, error) {
 		}
 	}
 
-	if key, err := x509.ParseECPrivateKey(keyBlockDER.Bytes); err == nil {
+	if key, err := x509.ParseECPrivateKey(derBytes); err == nil {
 		return key, nil
 	}
 
@@ -119,37 +168,279 @@ func trusted(cert *x509.Certificate) bool {
 
 // KeyPair represents a public-private key pair, where the
 // public key is also called a certificate.
+//
+// Format controls how Certificate and PrivateKey are interpreted:
+// "pem_file" (the default) treats them as paths to PEM files; "pem"
+// treats them as PEM text directly; "pem_env" treats them as the names
+// of environment variables holding the PEM text; "pkcs12"/"pkcs12_file"
+// decode a PKCS#12 archive (see Archive); and "key_source" loads the
+// private key from the KeySourceRaw module instead of PrivateKey.
 type KeyPair struct {
 	Certificate string `json:"certificate,omitempty"`
 	PrivateKey  string `json:"private_key,omitempty"`
 	Format      string `json:"format,omitempty"`
+
+	// Passphrase is used to decrypt PrivateKey, if it is PEM-encrypted
+	// (for example, a key generated with `openssl ... -aes256`).
+	Passphrase string `json:"passphrase,omitempty"`
+
+	// PassphraseEnv is like Passphrase, but names an environment
+	// variable to read the passphrase from, so it need not be stored
+	// in the config. If both are set, PassphraseEnv takes precedence.
+	PassphraseEnv string `json:"passphrase_env,omitempty"`
+
+	// Archive holds the PKCS#12 (.pfx/.p12) archive to load, for the
+	// "pkcs12" and "pkcs12_file" formats. If empty, Certificate is used
+	// as the archive (or its path) instead, since a PKCS#12 archive
+	// bundles the cert and key together. Passphrase/PassphraseEnv, if
+	// set, are used as the archive password. For "pkcs12_file", this is
+	// a filesystem path; for "pkcs12", the archive is binary and must
+	// be base64-encoded, since it cannot be carried verbatim in JSON.
+	Archive string `json:"archive,omitempty"`
+
+	// KeySourceRaw is the configuration for a pki.key_sources module,
+	// used for the "key_source" format in place of PrivateKey. It
+	// supplies a crypto.Signer to sign with instead of a raw private
+	// key parsed from PEM, so the key material itself (e.g. held in an
+	// HSM, PKCS#11 token, or cloud KMS) never needs to be on the host.
+	KeySourceRaw json.RawMessage `json:"key_source,omitempty" caddy:"namespace=pki.key_sources inline_key=source"`
+
+	keySource KeySource
+}
+
+// Provision sets up kp, loading its KeySourceRaw module if Format is
+// "key_source". It is a no-op for any other format, and must be called
+// before Load or LoadChain when a key source is used.
+//
+// NOTE: this source tree does not (yet) contain the caddypki
+// provisioning code that constructs KeyPair values from config (e.g.
+// CA/trust-store loading), so nothing here calls Provision yet and the
+// "key_source" format is unreachable until such a caller is added and
+// updated to call it.
+func (kp *KeyPair) Provision(ctx caddy.Context) error {
+	if kp.Format != "key_source" {
+		return nil
+	}
+	val, err := ctx.LoadModule(kp, "KeySourceRaw")
+	if err != nil {
+		return fmt.Errorf("loading key source module: %v", err)
+	}
+	ks, ok := val.(KeySource)
+	if !ok {
+		return fmt.Errorf("module %T is not a KeySource", val)
+	}
+	kp.keySource = ks
+	return nil
 }
 
 // Load loads the certificate and key.
 func (kp KeyPair) Load() (*x509.Certificate, interface{}, error) {
 	switch kp.Format {
-	case "", "pem_file":
-		certData, err := ioutil.ReadFile(kp.Certificate)
+	case "", "pem_file", "pem", "pem_env":
+		certData, keyData, err := kp.pemSourceBytes()
 		if err != nil {
 			return nil, nil, err
 		}
-		keyData, err := ioutil.ReadFile(kp.PrivateKey)
+
+		passphrase, err := kp.passphraseBytes()
 		if err != nil {
 			return nil, nil, err
 		}
+		defer zero(passphrase)
 
 		cert, err := pemDecodeSingleCert(certData)
 		if err != nil {
 			return nil, nil, err
 		}
-		key, err := pemDecodePrivateKey(keyData)
+		key, err := pemDecodePrivateKey(keyData, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return cert, key, nil
+
+	case "pkcs12_file", "pkcs12":
+		archiveData, err := kp.archiveBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		passphrase, err := kp.passphraseBytes()
 		if err != nil {
 			return nil, nil, err
 		}
+		defer zero(passphrase)
+
+		key, cert, err := pkcs12.Decode(archiveData, string(passphrase))
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding PKCS#12 archive: %v", err)
+		}
 
 		return cert, key, nil
 
+	case "key_source":
+		if kp.keySource == nil {
+			return nil, nil, fmt.Errorf("key_source format requires KeyPair.Provision to be called first")
+		}
+		certData, err := ioutil.ReadFile(kp.Certificate)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert, err := pemDecodeSingleCert(certData)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := kp.keySource.KeySigner()
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, signer, nil
+
 	default:
 		return nil, nil, fmt.Errorf("unsupported format: %s", kp.Format)
 	}
 }
+
+// LoadChain is like Load, but also returns any intermediate certificates
+// bundled alongside the leaf certificate, such as those found in a
+// PKCS#12 archive or a concatenated PEM bundle (e.g. fullchain.pem), so
+// the full chain can be installed.
+//
+// NOTE: this source tree does not (yet) contain caddypki's CA-loading or
+// trust-store-installation code, so no caller here has been switched
+// from Load to LoadChain. Callers that currently install only the leaf
+// certificate should be updated to use LoadChain once that code is
+// present, so bundled intermediates are actually installed.
+func (kp KeyPair) LoadChain() ([]*x509.Certificate, crypto.PrivateKey, error) {
+	switch kp.Format {
+	case "", "pem_file", "pem", "pem_env":
+		certData, keyData, err := kp.pemSourceBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		passphrase, err := kp.passphraseBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer zero(passphrase)
+
+		certs, err := pemDecodeCertBundle(certData)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := pemDecodePrivateKey(keyData, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return certs, key, nil
+
+	case "pkcs12_file", "pkcs12":
+		archiveData, err := kp.archiveBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		passphrase, err := kp.passphraseBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer zero(passphrase)
+
+		key, cert, caCerts, err := pkcs12.DecodeChain(archiveData, string(passphrase))
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding PKCS#12 archive: %v", err)
+		}
+
+		return append([]*x509.Certificate{cert}, caCerts...), key, nil
+
+	default:
+		cert, key, err := kp.Load()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []*x509.Certificate{cert}, key, nil
+	}
+}
+
+// pemSourceBytes resolves the raw certificate and private key PEM bytes
+// for the "pem_file", "pem", and "pem_env" formats: pem_file reads them
+// from the file paths in Certificate/PrivateKey, pem takes the PEM text
+// directly from those fields, and pem_env reads the PEM text from the
+// environment variables they name.
+func (kp KeyPair) pemSourceBytes() (certData, keyData []byte, err error) {
+	switch kp.Format {
+	case "", "pem_file":
+		certData, err = ioutil.ReadFile(kp.Certificate)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyData, err = ioutil.ReadFile(kp.PrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return certData, keyData, nil
+
+	case "pem":
+		return []byte(kp.Certificate), []byte(kp.PrivateKey), nil
+
+	case "pem_env":
+		cert, ok := os.LookupEnv(kp.Certificate)
+		if !ok {
+			return nil, nil, fmt.Errorf("environment variable %q is not set", kp.Certificate)
+		}
+		key, ok := os.LookupEnv(kp.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("environment variable %q is not set", kp.PrivateKey)
+		}
+		return []byte(cert), []byte(key), nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported format: %s", kp.Format)
+	}
+}
+
+// archiveBytes resolves the PKCS#12 archive bytes for the "pkcs12" and
+// "pkcs12_file" formats, reading from disk in the _file variant. The
+// "pkcs12" variant is binary DER, so it cannot be carried verbatim in a
+// JSON string; it must be base64-encoded in the config and is decoded
+// here.
+func (kp KeyPair) archiveBytes() ([]byte, error) {
+	archive := kp.Archive
+	if archive == "" {
+		archive = kp.Certificate
+	}
+	if kp.Format == "pkcs12_file" {
+		return ioutil.ReadFile(archive)
+	}
+	return base64.StdEncoding.DecodeString(archive)
+}
+
+// passphraseBytes resolves the passphrase to use for decrypting an
+// encrypted private key, preferring PassphraseEnv over Passphrase if
+// both are set for some reason. It returns a nil slice, without error,
+// if neither is set.
+func (kp KeyPair) passphraseBytes() ([]byte, error) {
+	if kp.PassphraseEnv != "" {
+		val, ok := os.LookupEnv(kp.PassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %q is not set", kp.PassphraseEnv)
+		}
+		if val == "" {
+			return nil, fmt.Errorf("environment variable %q is empty", kp.PassphraseEnv)
+		}
+		return []byte(val), nil
+	}
+	if kp.Passphrase != "" {
+		return []byte(kp.Passphrase), nil
+	}
+	return nil, nil
+}
+
+// zero zeroes out the contents of b.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
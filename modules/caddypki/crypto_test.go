@@ -0,0 +1,207 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caddypki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func generateTestECKeyPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling test key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func generateTestCertPEM(t *testing.T, commonName string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating test cert: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestPemDecodeCertBundle(t *testing.T) {
+	leaf := generateTestCertPEM(t, "leaf")
+	intermediate := generateTestCertPEM(t, "intermediate")
+
+	t.Run("single cert", func(t *testing.T) {
+		certs, err := pemDecodeCertBundle(leaf)
+		if err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+		if len(certs) != 1 {
+			t.Fatalf("expected 1 cert, got %d", len(certs))
+		}
+		if certs[0].Subject.CommonName != "leaf" {
+			t.Fatalf("expected leaf cert first, got %q", certs[0].Subject.CommonName)
+		}
+	})
+
+	t.Run("leaf and intermediate", func(t *testing.T) {
+		bundle := append(append([]byte{}, leaf...), intermediate...)
+		certs, err := pemDecodeCertBundle(bundle)
+		if err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+		if len(certs) != 2 {
+			t.Fatalf("expected 2 certs, got %d", len(certs))
+		}
+		if certs[0].Subject.CommonName != "leaf" || certs[1].Subject.CommonName != "intermediate" {
+			t.Fatalf("unexpected cert order: %q, %q", certs[0].Subject.CommonName, certs[1].Subject.CommonName)
+		}
+	})
+
+	t.Run("no certificates", func(t *testing.T) {
+		keyPEM := generateTestECKeyPEM(t)
+		if _, err := pemDecodeCertBundle(keyPEM); err == nil {
+			t.Fatal("expected error when no CERTIFICATE blocks are present, got none")
+		}
+		if _, err := pemDecodeCertBundle([]byte("not a PEM block")); err == nil {
+			t.Fatal("expected error for non-PEM input, got none")
+		}
+	})
+}
+
+func TestPemDecodePrivateKeyEncrypted(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling test key: %v", err)
+	}
+	//nolint:staticcheck
+	encBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte("correct horse"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatalf("encrypting test key: %v", err)
+	}
+	encPEM := pem.EncodeToMemory(encBlock)
+
+	t.Run("correct passphrase", func(t *testing.T) {
+		if _, err := pemDecodePrivateKey(encPEM, []byte("correct horse")); err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		if _, err := pemDecodePrivateKey(encPEM, []byte("wrong passphrase")); err == nil {
+			t.Fatal("expected error with wrong passphrase, got none")
+		}
+	})
+
+	t.Run("empty passphrase", func(t *testing.T) {
+		if _, err := pemDecodePrivateKey(encPEM, nil); err == nil {
+			t.Fatal("expected error with empty passphrase, got none")
+		}
+	})
+
+	t.Run("unencrypted key ignores passphrase", func(t *testing.T) {
+		plainPEM := generateTestECKeyPEM(t)
+		if _, err := pemDecodePrivateKey(plainPEM, []byte("correct horse")); err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+	})
+
+	t.Run("garbage input does not panic", func(t *testing.T) {
+		if _, err := pemDecodePrivateKey([]byte("not a PEM block"), nil); err == nil {
+			t.Fatal("expected error for non-PEM input, got none")
+		}
+	})
+}
+
+func TestKeyPairPemSourceBytes(t *testing.T) {
+	t.Run("pem", func(t *testing.T) {
+		kp := KeyPair{
+			Format:      "pem",
+			Certificate: "cert-pem-text",
+			PrivateKey:  "key-pem-text",
+		}
+		certData, keyData, err := kp.pemSourceBytes()
+		if err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+		if string(certData) != "cert-pem-text" || string(keyData) != "key-pem-text" {
+			t.Fatalf("unexpected data: cert=%q key=%q", certData, keyData)
+		}
+	})
+
+	t.Run("pem_env success", func(t *testing.T) {
+		t.Setenv("TEST_CADDYPKI_CERT", "cert-pem-text")
+		t.Setenv("TEST_CADDYPKI_KEY", "key-pem-text")
+		kp := KeyPair{
+			Format:      "pem_env",
+			Certificate: "TEST_CADDYPKI_CERT",
+			PrivateKey:  "TEST_CADDYPKI_KEY",
+		}
+		certData, keyData, err := kp.pemSourceBytes()
+		if err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+		if string(certData) != "cert-pem-text" || string(keyData) != "key-pem-text" {
+			t.Fatalf("unexpected data: cert=%q key=%q", certData, keyData)
+		}
+	})
+
+	t.Run("pem_env missing certificate env var", func(t *testing.T) {
+		t.Setenv("TEST_CADDYPKI_KEY", "key-pem-text")
+		kp := KeyPair{
+			Format:      "pem_env",
+			Certificate: "TEST_CADDYPKI_CERT_DOES_NOT_EXIST",
+			PrivateKey:  "TEST_CADDYPKI_KEY",
+		}
+		if _, _, err := kp.pemSourceBytes(); err == nil {
+			t.Fatal("expected error for missing certificate env var, got none")
+		}
+	})
+
+	t.Run("pem_env missing private key env var", func(t *testing.T) {
+		t.Setenv("TEST_CADDYPKI_CERT", "cert-pem-text")
+		kp := KeyPair{
+			Format:      "pem_env",
+			Certificate: "TEST_CADDYPKI_CERT",
+			PrivateKey:  "TEST_CADDYPKI_KEY_DOES_NOT_EXIST",
+		}
+		if _, _, err := kp.pemSourceBytes(); err == nil {
+			t.Fatal("expected error for missing private key env var, got none")
+		}
+	})
+}
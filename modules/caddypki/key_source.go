@@ -0,0 +1,152 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caddypki
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(KeySourceFile{})
+	caddy.RegisterModule(KeySourceEnv{})
+}
+
+// KeySource is implemented by modules in the "pki.key_sources" namespace
+// that can supply a crypto.Signer to use as a KeyPair's private key,
+// rather than one parsed directly out of PEM material. This allows
+// private keys to be kept off the Caddy host entirely, e.g. backed by
+// an HSM, a PKCS#11 token, or a cloud KMS.
+//
+// Only KeySourceFile and KeySourceEnv are implemented so far, and
+// neither actually keeps the key off the host: KeySourceFile reads a
+// local file and KeySourceEnv reads a local environment variable. They
+// exist to exercise the KeySource extension point and cover the
+// containerized/Kubernetes-Secret case where the key is injected via
+// env rather than a config field. An HSM/PKCS#11 or cloud KMS-backed
+// KeySource, which would be needed to keep key material off the host
+// for regulated deployments, is not yet implemented.
+type KeySource interface {
+	// KeySigner returns the signer to use as the private key.
+	KeySigner() (crypto.Signer, error)
+}
+
+// KeySourceFile is a KeySource that loads a signer from a PEM-encoded
+// private key file on disk. It behaves like KeyPair's "pem_file" format,
+// but as a key_sources module, for use anywhere a key source is needed.
+type KeySourceFile struct {
+	// Filename is the path to the PEM-encoded private key file.
+	Filename string `json:"filename,omitempty"`
+
+	// Passphrase is used to decrypt Filename, if it is PEM-encrypted.
+	Passphrase string `json:"passphrase,omitempty"`
+
+	// PassphraseEnv is like Passphrase, but names an environment
+	// variable to read the passphrase from.
+	PassphraseEnv string `json:"passphrase_env,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (KeySourceFile) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "pki.key_sources.file",
+		New: func() caddy.Module { return new(KeySourceFile) },
+	}
+}
+
+// KeySigner implements KeySource.
+func (ks KeySourceFile) KeySigner() (crypto.Signer, error) {
+	keyData, err := ioutil.ReadFile(ks.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	kp := KeyPair{Passphrase: ks.Passphrase, PassphraseEnv: ks.PassphraseEnv}
+	passphrase, err := kp.passphraseBytes()
+	if err != nil {
+		return nil, err
+	}
+	defer zero(passphrase)
+
+	key, err := pemDecodePrivateKey(keyData, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T does not implement crypto.Signer", key)
+	}
+	return signer, nil
+}
+
+// Interface guard
+var _ KeySource = (*KeySourceFile)(nil)
+
+// KeySourceEnv is a KeySource that loads a signer from PEM text stored in
+// an environment variable, instead of a file on disk. It behaves like
+// KeyPair's "pem_env" format, but as a key_sources module.
+type KeySourceEnv struct {
+	// KeyEnv names the environment variable holding the PEM-encoded
+	// private key.
+	KeyEnv string `json:"key_env,omitempty"`
+
+	// Passphrase is used to decrypt the key named by KeyEnv, if it is
+	// PEM-encrypted.
+	Passphrase string `json:"passphrase,omitempty"`
+
+	// PassphraseEnv is like Passphrase, but names an environment
+	// variable to read the passphrase from.
+	PassphraseEnv string `json:"passphrase_env,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (KeySourceEnv) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "pki.key_sources.env",
+		New: func() caddy.Module { return new(KeySourceEnv) },
+	}
+}
+
+// KeySigner implements KeySource.
+func (ks KeySourceEnv) KeySigner() (crypto.Signer, error) {
+	keyPEM, ok := os.LookupEnv(ks.KeyEnv)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %q is not set", ks.KeyEnv)
+	}
+
+	kp := KeyPair{Passphrase: ks.Passphrase, PassphraseEnv: ks.PassphraseEnv}
+	passphrase, err := kp.passphraseBytes()
+	if err != nil {
+		return nil, err
+	}
+	defer zero(passphrase)
+
+	key, err := pemDecodePrivateKey([]byte(keyPEM), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T does not implement crypto.Signer", key)
+	}
+	return signer, nil
+}
+
+// Interface guard
+var _ KeySource = (*KeySourceEnv)(nil)
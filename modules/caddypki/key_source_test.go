@@ -0,0 +1,36 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caddypki
+
+import "testing"
+
+func TestKeySourceEnv(t *testing.T) {
+	keyPEM := generateTestECKeyPEM(t)
+
+	t.Run("success", func(t *testing.T) {
+		t.Setenv("TEST_CADDYPKI_KEY", string(keyPEM))
+		ks := KeySourceEnv{KeyEnv: "TEST_CADDYPKI_KEY"}
+		if _, err := ks.KeySigner(); err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+	})
+
+	t.Run("missing env var", func(t *testing.T) {
+		ks := KeySourceEnv{KeyEnv: "TEST_CADDYPKI_KEY_DOES_NOT_EXIST"}
+		if _, err := ks.KeySigner(); err == nil {
+			t.Fatal("expected error for missing environment variable, got none")
+		}
+	})
+}